@@ -0,0 +1,83 @@
+// Copyright 2019 Altinity Ltd and/or its affiliates. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Exporter tracks the ClickHouseInstallation-controlled state the chi controller reports
+// on, and exposes it to Prometheus. Reconcile loops talk to it instead of the registry
+// directly so that the state a CHI last published can be compared with what it is about
+// to publish, avoiding a metric update on every reconcile that changed nothing.
+type Exporter struct {
+	mu         sync.Mutex
+	controlled map[string][]string
+
+	reconcileDuration prometheus.Histogram
+	reconcileErrors   prometheus.Counter
+}
+
+// NewExporter creates an Exporter and registers its collectors with registerer.
+func NewExporter(registerer prometheus.Registerer) *Exporter {
+	exporter := &Exporter{
+		controlled: make(map[string][]string),
+		reconcileDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "reconcile_duration_seconds",
+			Help:    "Time spent in a single ClickHouseInstallation reconcile",
+			Buckets: prometheus.DefBuckets,
+		}),
+		reconcileErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reconcile_errors_total",
+			Help: "Total number of ClickHouseInstallation reconciles that returned an error",
+		}),
+	}
+	registerer.MustRegister(exporter.reconcileDuration, exporter.reconcileErrors)
+	return exporter
+}
+
+// ControlledValuesExist reports whether chiName is already tracked with exactly hostnames.
+func (e *Exporter) ControlledValuesExist(chiName string, hostnames []string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return reflect.DeepEqual(e.controlled[chiName], hostnames)
+}
+
+// UpdateControlledState replaces the tracked hostnames for chiName.
+func (e *Exporter) UpdateControlledState(chiName string, hostnames []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.controlled[chiName] = hostnames
+}
+
+// DeleteControlledState drops chiName from the tracked state, e.g. once it has been deleted.
+func (e *Exporter) DeleteControlledState(chiName string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.controlled, chiName)
+}
+
+// ObserveReconcileDuration records how long a single reconcile took.
+func (e *Exporter) ObserveReconcileDuration(seconds float64) {
+	e.reconcileDuration.Observe(seconds)
+}
+
+// IncReconcileErrors increments the count of reconciles that returned an error.
+func (e *Exporter) IncReconcileErrors() {
+	e.reconcileErrors.Inc()
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Altinity Ltd and/or its affiliates. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chi
+
+import (
+	"context"
+
+	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/go-logr/logr"
+)
+
+// chiCRDName is the CHI CustomResourceDefinition the operator cannot run without. Any future
+// dependency such as a ClickHouseInstallationTemplate CRD belongs alongside it below.
+const chiCRDName = "clickhouseinstallations.clickhouse.altinity.com"
+
+// WaitForCRDs blocks until every CRD named in names is Established and NamesAccepted, or ctx
+// is cancelled. Deploying the operator alongside its own CRD manifest in the same Helm/Kustomize
+// apply means chopInformer can start syncing before the CRD actually exists yet, leaving the
+// worker loop spinning with no progress; calling this before waitForCacheSync avoids that.
+// It is finish-once: it returns as soon as every required CRD is ready and does not keep watching.
+// Readiness is observed through a CustomResourceDefinition watch rather than polling Get, so
+// there is no steady background load on the API server while we wait.
+func WaitForCRDs(ctx context.Context, log logr.Logger, apiextClient apiextensionsclientset.Interface, names ...string) error {
+	log.V(1).Info("Waiting for CRDs to become established", "crds", names)
+
+	crdClient := apiextClient.ApiextensionsV1beta1().CustomResourceDefinitions()
+
+	pending := make(map[string]bool, len(names))
+	for _, name := range names {
+		pending[name] = true
+	}
+
+	for len(pending) > 0 {
+		list, err := crdClient.List(meta.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range list.Items {
+			crd := &list.Items[i]
+			if pending[crd.Name] && crdEstablished(crd) {
+				delete(pending, crd.Name)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		watcher, err := crdClient.Watch(meta.ListOptions{ResourceVersion: list.ResourceVersion})
+		if err != nil {
+			return err
+		}
+
+		pending, err = waitForEstablished(ctx, watcher, pending)
+		watcher.Stop()
+		if err != nil {
+			return err
+		}
+	}
+
+	log.V(1).Info("All required CRDs are established")
+	return nil
+}
+
+// waitForEstablished consumes watcher until every CRD named in pending is Established and
+// NamesAccepted (returning the, by then empty, pending map), ctx is cancelled, or the watch
+// itself closes - in which case the caller re-establishes it with a fresh resourceVersion.
+func waitForEstablished(ctx context.Context, watcher watch.Interface, pending map[string]bool) (map[string]bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return pending, ctx.Err()
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return pending, nil
+			}
+			if event.Type == watch.Error {
+				return pending, apierrors.FromObject(event.Object)
+			}
+			crd, ok := event.Object.(*apiextensions.CustomResourceDefinition)
+			if !ok || !pending[crd.Name] {
+				continue
+			}
+			if event.Type == watch.Deleted {
+				continue
+			}
+			if crdEstablished(crd) {
+				delete(pending, crd.Name)
+				if len(pending) == 0 {
+					return pending, nil
+				}
+			}
+		}
+	}
+}
+
+// crdEstablished reports whether crd has both its Established and NamesAccepted conditions True
+func crdEstablished(crd *apiextensions.CustomResourceDefinition) bool {
+	established, namesAccepted := false, false
+	for _, cond := range crd.Status.Conditions {
+		switch cond.Type {
+		case apiextensions.Established:
+			established = cond.Status == apiextensions.ConditionTrue
+		case apiextensions.NamesAccepted:
+			namesAccepted = cond.Status == apiextensions.ConditionTrue
+		}
+	}
+	return established && namesAccepted
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 Altinity Ltd and/or its affiliates. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/go-logr/logr"
+)
+
+func establishedCRD(name string) *apiextensions.CustomResourceDefinition {
+	return &apiextensions.CustomResourceDefinition{
+		ObjectMeta: meta.ObjectMeta{Name: name},
+		Status: apiextensions.CustomResourceDefinitionStatus{
+			Conditions: []apiextensions.CustomResourceDefinitionCondition{
+				{Type: apiextensions.Established, Status: apiextensions.ConditionTrue},
+				{Type: apiextensions.NamesAccepted, Status: apiextensions.ConditionTrue},
+			},
+		},
+	}
+}
+
+// TestWaitForCRDsReturnsImmediatelyWhenAlreadyEstablished covers the initial List() pass:
+// a CRD that is already Established before the watch starts must not block.
+func TestWaitForCRDsReturnsImmediatelyWhenAlreadyEstablished(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset(establishedCRD(chiCRDName))
+
+	if err := WaitForCRDs(context.Background(), logr.Discard(), client, chiCRDName); err != nil {
+		t.Fatalf("WaitForCRDs() returned error: %v", err)
+	}
+}
+
+// TestWaitForCRDsUnblocksOnWatchEvent covers the retry loop: a CRD that only becomes
+// Established after WaitForCRDs starts watching must still unblock it.
+func TestWaitForCRDsUnblocksOnWatchEvent(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- WaitForCRDs(context.Background(), logr.Discard(), client, chiCRDName)
+	}()
+
+	// Give WaitForCRDs time to get past its initial List() and establish the watch before
+	// the CRD shows up, exercising the retry loop rather than the already-established path.
+	time.Sleep(50 * time.Millisecond)
+	if err := client.Tracker().Add(establishedCRD(chiCRDName)); err != nil {
+		t.Fatalf("seeding the fake tracker: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitForCRDs() returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("WaitForCRDs() did not return after the CRD became established")
+	}
+}
+
+// TestWaitForCRDsReturnsOnContextCancel covers a CRD that never becomes established: the
+// caller's ctx cancellation must unblock the wait instead of hanging forever.
+func TestWaitForCRDsReturnsOnContextCancel(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- WaitForCRDs(ctx, logr.Discard(), client, chiCRDName)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("WaitForCRDs() returned nil error after ctx was cancelled, want ctx.Err()")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("WaitForCRDs() did not return after ctx was cancelled")
+	}
+}
+
+func TestCrdEstablished(t *testing.T) {
+	if !crdEstablished(establishedCRD("foo")) {
+		t.Fatal("crdEstablished() = false for a CRD with both conditions True, want true")
+	}
+
+	pending := establishedCRD("foo")
+	pending.Status.Conditions[0].Status = apiextensions.ConditionFalse
+	if crdEstablished(pending) {
+		t.Fatal("crdEstablished() = true for a CRD with Established=False, want false")
+	}
+}
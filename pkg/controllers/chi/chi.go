@@ -27,6 +27,8 @@ import (
 	choplisters "github.com/altinity/clickhouse-operator/pkg/client/listers/clickhouse.altinity.com/v1"
 	chopparser "github.com/altinity/clickhouse-operator/pkg/parser"
 
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+
 	apps "k8s.io/api/apps/v1"
 	core "k8s.io/api/core/v1"
 
@@ -47,12 +49,14 @@ import (
 	record "k8s.io/client-go/tools/record"
 	workqueue "k8s.io/client-go/util/workqueue"
 
-	"github.com/golang/glog"
+	"github.com/go-logr/logr"
+	klogr "k8s.io/klog/klogr"
 )
 
 // Controller defines CRO controller
 type Controller struct {
 	kubeClient              kube.Interface
+	apiextClient            apiextensionsclientset.Interface
 	chopClient              chopclientset.Interface
 	chopLister              choplisters.ClickHouseInstallationLister
 	chopListerSynced        cache.InformerSynced
@@ -65,37 +69,50 @@ type Controller struct {
 	queue                   workqueue.RateLimitingInterface
 	recorder                record.EventRecorder
 	metricsExporter         *chopmetrics.Exporter
+	leaderElection          LeaderElectionConfig
+	replicaCounter          ReplicaCounter
+	leaseCounter            *LeaseBackedCounter
+	log                     logr.Logger
 }
 
 const (
-	componentName = "clickhouse-operator"
+	componentName   = "clickhouse-operator"
 	runWorkerPeriod = time.Second
 )
 
 const (
-	successSynced         = "Synced"
-	errResourceExists     = "ErrResourceExists"
-	messageResourceSynced = "ClickHouseInstallation synced successfully"
-	messageResourceExists = "Resource %q already exists and is not managed by ClickHouseInstallation"
-	messageUnableToDecode = "Unable to decode object (invalid type)"
-	messageUnableToSync   = "Unable to sync caches for %s controller"
+	successSynced           = "Synced"
+	errResourceExists       = "ErrResourceExists"
+	errResourceUpdateFailed = "ErrResourceUpdateFailed"
+	messageResourceSynced   = "ClickHouseInstallation synced successfully"
+	messageResourceExists   = "Resource %q already exists and is not managed by ClickHouseInstallation"
+	messageUnableToDecode   = "Unable to decode object (invalid type)"
+	messageUnableToSync     = "Unable to sync caches for %s controller"
 )
 
 // CreateController creates instance of Controller
 func CreateController(
 	chopClient chopclientset.Interface,
 	kubeClient kube.Interface,
+	apiextClient apiextensionsclientset.Interface,
 	chopInformer chopinformers.ClickHouseInstallationInformer,
 	ssInformer appsinformers.StatefulSetInformer,
 	cmInformer coreinformers.ConfigMapInformer,
 	serviceInformer coreinformers.ServiceInformer,
 	chopMetricsExporter *chopmetrics.Exporter,
+	leaderElection LeaderElectionConfig,
+	replicaCacheTTL time.Duration,
+	leaseDuration time.Duration,
 ) *Controller {
 
 	// Initializations
+	log := klogr.New().WithName(componentName)
+
 	chopclientsetscheme.AddToScheme(scheme.Scheme)
 	eventBroadcaster := record.NewBroadcaster()
-	eventBroadcaster.StartLogging(glog.Infof)
+	eventBroadcaster.StartLogging(func(format string, args ...interface{}) {
+		log.Info(fmt.Sprintf(format, args...))
+	})
 	eventBroadcaster.StartRecordingToSink(
 		&typedcore.EventSinkImpl{
 			Interface: kubeClient.CoreV1().Events(""),
@@ -111,6 +128,7 @@ func CreateController(
 	// Creating Controller instance
 	controller := &Controller{
 		kubeClient:              kubeClient,
+		apiextClient:            apiextClient,
 		chopClient:              chopClient,
 		chopLister:              chopInformer.Lister(),
 		chopListerSynced:        chopInformer.Informer().HasSynced,
@@ -123,7 +141,14 @@ func CreateController(
 		queue:                   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "chi"),
 		recorder:                recorder,
 		metricsExporter:         chopMetricsExporter,
+		leaderElection:          leaderElection,
+		log:                     log,
 	}
+	controller.replicaCounter = NewCachedReplicaCounter(
+		NewStatefulSetCounter(ssInformer.Lister(), chopInformer.Lister()),
+		replicaCacheTTL,
+	)
+	controller.leaseCounter = NewLeaseBackedCounter(kubeClient, leaseDuration, log)
 	chopInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: controller.enqueueObject,
 		UpdateFunc: func(old, new interface{}) {
@@ -151,8 +176,17 @@ func (c *Controller) Run(ctx context.Context, threadiness int) {
 	defer utilruntime.HandleCrash()
 	defer c.queue.ShutDown()
 
-	glog.V(1).Info("Starting ClickHouseInstallation controller")
+	c.log.V(1).Info("Starting ClickHouseInstallation controller")
+
+	if c.apiextClient != nil {
+		if err := WaitForCRDs(ctx, c.log, c.apiextClient, chiCRDName); err != nil {
+			utilruntime.HandleError(fmt.Errorf("unable to wait for required CRDs: %s", err.Error()))
+			return
+		}
+	}
+
 	if !waitForCacheSync(
+		c.log,
 		"ClickHouseInstallation",
 		ctx.Done(),
 		c.chopListerSynced,
@@ -164,13 +198,24 @@ func (c *Controller) Run(ctx context.Context, threadiness int) {
 		return
 	}
 
-	glog.V(1).Info("ClickHouseInstallation controller: starting workers")
-	for i := 0; i < threadiness; i++ {
-		go wait.Until(c.runWorker, runWorkerPeriod, ctx.Done())
+	runWorkers := func(leaderCtx context.Context) {
+		c.log.V(1).Info("ClickHouseInstallation controller: starting workers")
+		for i := 0; i < threadiness; i++ {
+			go wait.Until(c.runWorker, runWorkerPeriod, leaderCtx.Done())
+		}
+		c.log.V(1).Info("ClickHouseInstallation controller: workers started")
+		defer c.log.V(1).Info("ClickHouseInstallation controller: shutting down workers")
+		<-leaderCtx.Done()
+	}
+
+	if c.leaderElection.Enabled {
+		// Only the elected leader runs the workers; on loss of leadership
+		// runWithLeaderElection exits the process so the Deployment restarts it.
+		c.runWithLeaderElection(ctx, runWorkers)
+		return
 	}
-	glog.V(1).Info("ClickHouseInstallation controller: workers started")
-	defer glog.V(1).Info("ClickHouseInstallation controller: shutting down workers")
-	<-ctx.Done()
+
+	runWorkers(ctx)
 }
 
 // runWorker is a convenience wrap over processNextWorkItem()
@@ -197,7 +242,11 @@ func (c *Controller) processNextWorkItem() bool {
 			return nil
 		}
 
-		if err := c.syncItem(stringItem); err != nil {
+		start := time.Now()
+		err := c.syncItem(stringItem)
+		c.metricsExporter.ObserveReconcileDuration(time.Since(start).Seconds())
+		if err != nil {
+			c.metricsExporter.IncReconcileErrors()
 			// Item will be retried later
 			return fmt.Errorf("unable to sync an object '%s': %s", stringItem, err.Error())
 		}
@@ -225,6 +274,10 @@ func (c *Controller) syncItem(key string) error {
 		return nil
 	}
 
+	// Every log line for this reconcile is tagged with the CHI it is about, so operator logs
+	// are grep-able per installation and, once piped through a JSON klog formatter, machine-parseable.
+	log := c.log.WithValues("chi", name, "namespace", namespace)
+
 	// Check CHI object in cache cache
 	chi, err := c.chopLister.ClickHouseInstallations(namespace).Get(name)
 	if err != nil {
@@ -236,134 +289,59 @@ func (c *Controller) syncItem(key string) error {
 		return err
 	}
 
-	// Check CHI object already in sync
-	if chi.Status.ObjectPrefixes == nil || len(chi.Status.ObjectPrefixes) == 0 {
-		prefixes, err := c.createControlledResources(chi)
-		if err != nil {
-			glog.V(2).Infof("ClickHouseInstallation (%q): unable to create controlled resources: %q", chi.Name, err)
-			return err
-		}
-		if err := c.updateChiStatus(chi, prefixes); err != nil {
-			glog.V(2).Infof("ClickHouseInstallation (%q): unable to update status of CHI resource: %q", chi.Name, err)
-			return err
-		}
-		glog.V(2).Infof("ClickHouseInstallation (%q): controlled resources are synced (created): %v", chi.Name, prefixes)
-	} else {
-		// Check consistency of existent resources controlled by the CHI object
-
-		// Number of prefixes - -which is number of Stateful Sets and number of Pods
-		prefixesNum := len(chi.Status.ObjectPrefixes)
-		// Pod hostnames of CH
-		chHostnames := make([]string, prefixesNum)
-
-		for i, prefix := range chi.Status.ObjectPrefixes {
-			// Verify we have Stateful Set with such a name
-			ssName := chopparser.CreateStatefulSetName(prefix)
-			_, err := c.statefulSetLister.StatefulSets(chi.Namespace).Get(ssName)
-			if err == nil {
-				// TODO: check all controlled objects
-				glog.V(2).Infof("ClickHouseInstallation (%q) controls StatefulSet: %q", chi.Name, ssName)
-
-				// Prepare hostnames list for the chopmetrics.Exporter state storage
-				chHostnames[i] = chopparser.CreatePodHostname(chi.Namespace, prefix)
-			}
-		}
-
-		// Check hostnames of the Pods from current CHI object included into chopmetrics.Exporter state
-
-		if !c.metricsExporter.ControlledValuesExist(chi.Name, chHostnames) {
-			glog.V(2).Infof("ClickHouseInstallation (%q): including hostnames into chopmetrics.Exporter", chi.Name)
-			c.metricsExporter.UpdateControlledState(chi.Name, chHostnames)
-		}
+	if chi.DeletionTimestamp != nil {
+		return c.finalizeDeletion(log, chi)
 	}
 
-	return nil
-}
-
-// createControlledResources creates k8s resouces based on ClickHouseInstallation object specification
-func (c *Controller) createControlledResources(chi *chop.ClickHouseInstallation) ([]string, error) {
-	chiCopy := chi.DeepCopy()
-	chiObjects, prefixes := chopparser.CreateObjects(chiCopy)
-	for _, objList := range chiObjects {
-		switch v := objList.(type) {
-		case chopparser.ConfigMapList:
-			for _, obj := range v {
-				if err := c.createConfigMap(chiCopy, obj); err != nil {
-					return nil, err
-				}
-			}
-		case chopparser.ServiceList:
-			for _, obj := range v {
-				if err := c.createService(chiCopy, obj); err != nil {
-					return nil, err
-				}
-			}
-		case chopparser.StatefulSetList:
-			for _, obj := range v {
-				if err := c.createStatefulSet(chiCopy, obj); err != nil {
-					return nil, err
-				}
-			}
-		}
-	}
-	return prefixes, nil
-}
-
-// createConfigMap creates core.ConfigMap resource
-func (c *Controller) createConfigMap(chi *chop.ClickHouseInstallation, newConfigMap *core.ConfigMap) error {
-	res, err := c.configMapLister.ConfigMaps(chi.Namespace).Get(newConfigMap.Name)
-	if res != nil {
-		// ConfigMap with such name already exists
-		return nil
+	if err := c.ensureFinalizer(chi); err != nil {
+		log.V(2).Info("unable to register finalizer", "error", err)
+		return err
 	}
 
-	if apierrors.IsNotFound(err) {
-		// ConfigMap with such name not found - create it
-		_, err = c.kubeClient.CoreV1().ConfigMaps(chi.Namespace).Create(newConfigMap)
-	}
+	// Bring every controlled ConfigMap/Service/StatefulSet in line with the current spec,
+	// creating whatever is missing, updating whatever has drifted and pruning whatever is
+	// no longer present in the freshly parsed object set.
+	prefixes, err := c.reconcileControlledResources(log, chi)
 	if err != nil {
+		log.V(2).Info("unable to reconcile controlled resources", "error", err)
 		return err
 	}
-
-	return nil
-}
-
-// createService creates core.Service resource
-func (c *Controller) createService(chi *chop.ClickHouseInstallation, newService *core.Service) error {
-	res, err := c.serviceLister.Services(chi.Namespace).Get(newService.Name)
-	if res != nil {
-		// Service with such name already exists
-		return nil
+	if !stringSlicesEqual(chi.Status.ObjectPrefixes, prefixes) {
+		if err := c.updateChiStatus(chi, prefixes); err != nil {
+			log.V(2).Info("unable to update status of CHI resource", "error", err)
+			return err
+		}
 	}
-
-	if apierrors.IsNotFound(err) {
-		// Service with such name not found - create it
-		_, err = c.kubeClient.CoreV1().Services(chi.Namespace).Create(newService)
-	}
-	if err != nil {
-		return err
+	log.V(2).Info("controlled resources are synced", "prefixes", prefixes)
+
+	// Heartbeat/release the per-prefix replica Leases so external tooling can observe live
+	// replica membership without polling the API server.
+	c.publishReplicaLeases(log, chi, prefixes)
+
+	// Pod hostnames of CH, used to keep chopmetrics.Exporter state in sync. Going through
+	// c.replicaCounter (rather than deriving hostnames straight from prefixes) means only
+	// Ready replicas are reported, and repeated reconciles within the cache TTL cost no
+	// extra StatefulSet lookups.
+	chHostnames := c.replicaCounter.ListHostnames(chi.Namespace, chi.Name)
+	if !c.metricsExporter.ControlledValuesExist(chi.Name, chHostnames) {
+		log.V(2).Info("including hostnames into chopmetrics.Exporter", "hostnames", chHostnames)
+		c.metricsExporter.UpdateControlledState(chi.Name, chHostnames)
 	}
 
 	return nil
 }
 
-// createStatefulSet creates apps.StatefulSet resource
-func (c *Controller) createStatefulSet(chi *chop.ClickHouseInstallation, newStatefulSet *apps.StatefulSet) error {
-	res, err := c.statefulSetLister.StatefulSets(chi.Namespace).Get(newStatefulSet.Name)
-	if res != nil {
-		// StatefulSet with such name already exists
-		return nil
-	}
-
-	if apierrors.IsNotFound(err) {
-		// StatefulSet with such name not found - create it
-		_, err = c.kubeClient.AppsV1().StatefulSets(chi.Namespace).Create(newStatefulSet)
+// stringSlicesEqual reports whether a and b contain the same strings in the same order
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	if err != nil {
-		return err
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
-
-	return nil
+	return true
 }
 
 // updateChiStatus updates .status section of ClickHouseInstallation resource
@@ -420,13 +398,13 @@ func (c *Controller) handleObject(obj interface{}) {
 		return
 	}
 
-	glog.V(2).Infof("Processing object: %s", object.GetName())
+	c.log.V(2).Info("processing object", "object", object.GetName())
 
 	// Get owner - it is expected to be CHI
 	chi, err := c.chopLister.ClickHouseInstallations(object.GetNamespace()).Get(ownerRef.Name)
 
 	if err != nil {
-		glog.V(2).Infof("ignoring orphaned object '%s' of ClickHouseInstallation '%s'", object.GetSelfLink(), ownerRef.Name)
+		c.log.V(2).Info("ignoring orphaned object", "object", object.GetSelfLink(), "chi", ownerRef.Name)
 		return
 	}
 
@@ -435,30 +413,20 @@ func (c *Controller) handleObject(obj interface{}) {
 }
 
 // waitForCacheSync syncs informers cache
-func waitForCacheSync(n string, ch <-chan struct{}, syncs ...cache.InformerSynced) bool {
-	glog.V(1).Infof("Syncing caches for %s controller", n)
+func waitForCacheSync(log logr.Logger, n string, ch <-chan struct{}, syncs ...cache.InformerSynced) bool {
+	log.V(1).Info("Syncing caches for controller", "controller", n)
 	if !cache.WaitForCacheSync(ch, syncs...) {
 		utilruntime.HandleError(fmt.Errorf(messageUnableToSync, n))
 		return false
 	}
-	glog.V(1).Infof("Caches are synced for %s controller", n)
+	log.V(1).Info("Caches are synced for controller", "controller", n)
 	return true
 }
 
-// clusterWideSelector returns labels.Selector object
+// clusterWideSelector returns labels.Selector object matching every resource controlled by
+// the ClickHouseInstallation named name, regardless of which prefix/shard/replica it belongs to.
 func clusterWideSelector(name string) labels.Selector {
 	return labels.SelectorFromSet(labels.Set{
 		chopparser.ClusterwideLabel: name,
 	})
-	/*
-		glog.V(2).Infof("ClickHouseInstallation (%q) listing controlled resources", chi.Name)
-		ssList, err := c.statefulSetLister.StatefulSets(chi.Namespace).List(clusterWideSelector(chi.Name))
-		if err != nil {
-			return err
-		}
-		// Listing controlled resources
-		for i := range ssList {
-			glog.V(2).Infof("ClickHouseInstallation (%q) controlls StatefulSet: %q", chi.Name, ssList[i].Name)
-		}
-	*/
 }
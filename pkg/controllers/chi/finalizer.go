@@ -0,0 +1,113 @@
+// Copyright 2019 Altinity Ltd and/or its affiliates. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chi
+
+import (
+	"encoding/json"
+
+	chop "github.com/altinity/clickhouse-operator/pkg/apis/clickhouse.altinity.com/v1"
+
+	types "k8s.io/apimachinery/pkg/types"
+
+	"github.com/go-logr/logr"
+)
+
+// finalizerName guards a ClickHouseInstallation from being removed by the API server before
+// the operator has had a chance to tear down whatever it controls.
+const finalizerName = "clickhouse.altinity.com/finalizer"
+
+// finalizeDeletion runs when chi.DeletionTimestamp is set: it tears down controller-owned
+// state that isn't covered by owner references (metricsExporter bookkeeping, and explicitly
+// the children themselves when spec.cleanup requests it), then lets the API server complete
+// the delete by removing finalizerName.
+func (c *Controller) finalizeDeletion(log logr.Logger, chi *chop.ClickHouseInstallation) error {
+	if !hasFinalizer(chi.Finalizers, finalizerName) {
+		// Finalizer already removed (or never set) - nothing left for us to do
+		return nil
+	}
+
+	log.V(2).Info("running finalizer teardown")
+
+	c.metricsExporter.DeleteControlledState(chi.Name)
+
+	if chi.Spec.Cleanup {
+		if err := c.deleteControlledResources(log, chi); err != nil {
+			log.V(2).Info("unable to clean up controlled resources", "error", err)
+			return err
+		}
+	}
+
+	if err := c.removeFinalizer(chi); err != nil {
+		log.V(2).Info("unable to remove finalizer", "error", err)
+		return err
+	}
+
+	log.V(2).Info("finalized, deletion will proceed")
+	return nil
+}
+
+// deleteControlledResources explicitly deletes every StatefulSet, ConfigMap and Service
+// carrying chi's cluster-wide label, rather than relying on owner-reference cascading GC.
+// It is pruneOrphanedResources with an empty desired set, i.e. "nothing should survive".
+func (c *Controller) deleteControlledResources(log logr.Logger, chi *chop.ClickHouseInstallation) error {
+	none := map[string]bool{}
+	return c.pruneOrphanedResources(log, chi, none, none, none)
+}
+
+// ensureFinalizer patches finalizerName onto chi if it isn't already present.
+func (c *Controller) ensureFinalizer(chi *chop.ClickHouseInstallation) error {
+	if hasFinalizer(chi.Finalizers, finalizerName) {
+		return nil
+	}
+	return c.patchFinalizers(chi, append(append([]string{}, chi.Finalizers...), finalizerName))
+}
+
+// removeFinalizer patches finalizerName off chi, allowing the API server to finish deleting it.
+func (c *Controller) removeFinalizer(chi *chop.ClickHouseInstallation) error {
+	if !hasFinalizer(chi.Finalizers, finalizerName) {
+		return nil
+	}
+	finalizers := make([]string, 0, len(chi.Finalizers))
+	for _, f := range chi.Finalizers {
+		if f != finalizerName {
+			finalizers = append(finalizers, f)
+		}
+	}
+	return c.patchFinalizers(chi, finalizers)
+}
+
+// patchFinalizers issues a JSON merge patch replacing chi's metadata.finalizers
+func (c *Controller) patchFinalizers(chi *chop.ClickHouseInstallation, finalizers []string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers": finalizers,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.chopClient.ClickhouseV1().ClickHouseInstallations(chi.Namespace).Patch(chi.Name, types.MergePatchType, patch)
+	return err
+}
+
+// hasFinalizer reports whether name is present among finalizers
+func hasFinalizer(finalizers []string, name string) bool {
+	for _, f := range finalizers {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
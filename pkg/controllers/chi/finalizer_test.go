@@ -0,0 +1,158 @@
+// Copyright 2019 Altinity Ltd and/or its affiliates. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chi
+
+import (
+	"testing"
+
+	chop "github.com/altinity/clickhouse-operator/pkg/apis/clickhouse.altinity.com/v1"
+	chopmetrics "github.com/altinity/clickhouse-operator/pkg/apis/metrics"
+	chopfake "github.com/altinity/clickhouse-operator/pkg/client/clientset/versioned/fake"
+
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestDeleteControlledResourcesDeletesEverythingLabeled verifies that deleteControlledResources
+// (the finalizer's teardown of spec.cleanup: true CHIs) removes every cluster-labeled resource,
+// unlike pruneOrphanedResources during a normal reconcile which keeps whatever is still desired.
+func TestDeleteControlledResourcesDeletesEverythingLabeled(t *testing.T) {
+	cm := labeledConfigMap("data")
+
+	c, kubeClient := newReconcileTestController(t, cm)
+
+	if err := c.deleteControlledResources(logr.Discard(), testChi()); err != nil {
+		t.Fatalf("deleteControlledResources() returned error: %v", err)
+	}
+
+	cms, err := kubeClient.CoreV1().ConfigMaps(testNamespace).List(meta.ListOptions{})
+	if err != nil {
+		t.Fatalf("listing ConfigMaps: %v", err)
+	}
+	if len(cms.Items) != 0 {
+		t.Fatalf("expected every labeled ConfigMap to be deleted, got %v", cms.Items)
+	}
+}
+
+// newFinalizerTestController extends newReconcileTestController with a chopClient and
+// metricsExporter, the two fields finalizeDeletion's dispatch logic also touches.
+func newFinalizerTestController(t *testing.T, chi *chop.ClickHouseInstallation, objects ...runtime.Object) (*Controller, *chopfake.Clientset) {
+	t.Helper()
+
+	c, _ := newReconcileTestController(t, objects...)
+	chopClient := chopfake.NewSimpleClientset(chi)
+	c.chopClient = chopClient
+	c.metricsExporter = chopmetrics.NewExporter(prometheus.NewRegistry())
+	return c, chopClient
+}
+
+// TestFinalizeDeletionSkipsCleanupWhenNotRequested verifies that finalizeDeletion honors
+// spec.cleanup == false by removing the finalizer without touching controlled resources.
+func TestFinalizeDeletionSkipsCleanupWhenNotRequested(t *testing.T) {
+	chi := testChi()
+	chi.Finalizers = []string{finalizerName}
+	cm := labeledConfigMap("data")
+
+	c, chopClient := newFinalizerTestController(t, chi, cm)
+
+	if err := c.finalizeDeletion(logr.Discard(), chi); err != nil {
+		t.Fatalf("finalizeDeletion() returned error: %v", err)
+	}
+
+	cms, err := c.kubeClient.CoreV1().ConfigMaps(testNamespace).List(meta.ListOptions{})
+	if err != nil {
+		t.Fatalf("listing ConfigMaps: %v", err)
+	}
+	if len(cms.Items) != 1 {
+		t.Fatalf("finalizeDeletion() touched controlled resources with spec.cleanup == false, got %v", cms.Items)
+	}
+
+	updated, err := chopClient.ClickhouseV1().ClickHouseInstallations(testNamespace).Get(testChiName)
+	if err != nil {
+		t.Fatalf("getting patched CHI: %v", err)
+	}
+	if hasFinalizer(updated.Finalizers, finalizerName) {
+		t.Fatalf("finalizeDeletion() left %q in place, want it removed", finalizerName)
+	}
+}
+
+// TestFinalizeDeletionCleansUpControlledResourcesWhenRequested verifies that
+// spec.cleanup == true makes finalizeDeletion delete every controlled resource before
+// removing the finalizer.
+func TestFinalizeDeletionCleansUpControlledResourcesWhenRequested(t *testing.T) {
+	chi := testChi()
+	chi.Finalizers = []string{finalizerName}
+	chi.Spec.Cleanup = true
+	cm := labeledConfigMap("data")
+
+	c, chopClient := newFinalizerTestController(t, chi, cm)
+	kubeClient := c.kubeClient
+
+	if err := c.finalizeDeletion(logr.Discard(), chi); err != nil {
+		t.Fatalf("finalizeDeletion() returned error: %v", err)
+	}
+
+	cms, err := kubeClient.CoreV1().ConfigMaps(testNamespace).List(meta.ListOptions{})
+	if err != nil {
+		t.Fatalf("listing ConfigMaps: %v", err)
+	}
+	if len(cms.Items) != 0 {
+		t.Fatalf("expected every labeled ConfigMap to be deleted, got %v", cms.Items)
+	}
+
+	updated, err := chopClient.ClickhouseV1().ClickHouseInstallations(testNamespace).Get(testChiName)
+	if err != nil {
+		t.Fatalf("getting patched CHI: %v", err)
+	}
+	if hasFinalizer(updated.Finalizers, finalizerName) {
+		t.Fatalf("finalizeDeletion() left %q in place, want it removed", finalizerName)
+	}
+}
+
+// TestFinalizeDeletionIsNoOpWithoutTheFinalizer verifies the early-return path: a CHI that
+// never had (or already lost) the finalizer is left untouched.
+func TestFinalizeDeletionIsNoOpWithoutTheFinalizer(t *testing.T) {
+	chi := testChi()
+	chi.Spec.Cleanup = true
+	cm := labeledConfigMap("data")
+
+	c, _ := newFinalizerTestController(t, chi, cm)
+
+	if err := c.finalizeDeletion(logr.Discard(), chi); err != nil {
+		t.Fatalf("finalizeDeletion() returned error: %v", err)
+	}
+
+	cms, err := c.kubeClient.CoreV1().ConfigMaps(testNamespace).List(meta.ListOptions{})
+	if err != nil {
+		t.Fatalf("listing ConfigMaps: %v", err)
+	}
+	if len(cms.Items) != 1 {
+		t.Fatalf("finalizeDeletion() touched controlled resources without a finalizer present, got %v", cms.Items)
+	}
+}
+
+func TestHasFinalizer(t *testing.T) {
+	finalizers := []string{"other.example.com/finalizer", finalizerName}
+
+	if !hasFinalizer(finalizers, finalizerName) {
+		t.Fatalf("hasFinalizer() = false, want true for %v", finalizers)
+	}
+	if hasFinalizer(finalizers, "missing") {
+		t.Fatalf("hasFinalizer() = true, want false for an absent finalizer")
+	}
+}
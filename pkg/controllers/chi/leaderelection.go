@@ -0,0 +1,123 @@
+// Copyright 2019 Altinity Ltd and/or its affiliates. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chi
+
+import (
+	"context"
+	"os"
+	"time"
+
+	uuid "k8s.io/apimachinery/pkg/util/uuid"
+	coordination "k8s.io/client-go/tools/leaderelection"
+	resourcelock "k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderElectionConfig holds the parameters used to build the leader election
+// resource lock for the operator. Zero-value durations make DefaultLeaderElectionConfig
+// the source of sane defaults.
+type LeaderElectionConfig struct {
+	// Enabled turns leader election on. When false, Run() starts the workers immediately,
+	// which is the right choice for `replicas: 1` deployments and for local development.
+	Enabled bool
+	// Namespace is where the coordination.k8s.io/v1 Lease object is created/renewed.
+	Namespace string
+	// LeaseDuration is the duration non-leader candidates will wait before attempting to
+	// acquire leadership once the current leader stops renewing.
+	LeaseDuration time.Duration
+	// RenewDeadline is the duration the acting leader will retry refreshing leadership
+	// before giving it up.
+	RenewDeadline time.Duration
+	// RetryPeriod is how often the client should try to acquire/renew the lease.
+	RetryPeriod time.Duration
+}
+
+// DefaultLeaderElectionConfig returns the defaults mirrored from the
+// --leader-election-lease-duration/--leader-election-renew-deadline/--leader-election-retry-period flags.
+func DefaultLeaderElectionConfig() LeaderElectionConfig {
+	return LeaderElectionConfig{
+		Enabled:       false,
+		Namespace:     "kube-system",
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+	}
+}
+
+// runWithLeaderElection blocks running runLeader while this process holds the
+// "clickhouse-operator" Lease in the configured namespace. On loss of leadership it
+// exits the process non-zero itself so the Deployment restarts it; when ctx is cancelled
+// for an ordinary shutdown it returns normally.
+func (c *Controller) runWithLeaderElection(ctx context.Context, runLeader func(context.Context)) {
+	id := componentName + "_" + string(uuid.NewUUID())
+	lock, err := resourcelock.New(
+		resourcelock.LeasesResourceLock,
+		c.leaderElection.Namespace,
+		componentName,
+		c.kubeClient.CoreV1(),
+		c.kubeClient.CoordinationV1(),
+		resourcelock.ResourceLockConfig{
+			Identity:      id,
+			EventRecorder: c.recorder,
+		},
+	)
+	if err != nil {
+		c.log.Error(err, "unable to create leader election resource lock")
+		os.Exit(1)
+	}
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	coordination.RunOrDie(leaderCtx, coordination.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: c.leaderElection.LeaseDuration,
+		RenewDeadline: c.leaderElection.RenewDeadline,
+		RetryPeriod:   c.leaderElection.RetryPeriod,
+		Callbacks: coordination.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				c.log.V(1).Info("acquired leadership", "identity", id)
+				runLeader(leaderCtx)
+			},
+			OnStoppedLeading: func() {
+				// RunOrDie invokes this whenever the election loop exits, including an
+				// ordinary shutdown of ctx (e.g. SIGTERM during a rolling update) - not
+				// only genuine loss of leadership. Only force a restart in the latter
+				// case; an intentional shutdown returns normally so Run()'s deferred
+				// cleanup still runs.
+				if !lostLeadership(ctx) {
+					c.log.V(1).Info("leader election stopped due to shutdown", "identity", id)
+					return
+				}
+				c.log.V(0).Info("lost leadership, exiting so the Deployment restarts this replica", "identity", id)
+				// leaderCtx is already cancelled here, so wait.Until starts no new worker
+				// runs; a worker already inside runWorker keeps going until the exit below.
+				// Exit non-zero so the Deployment/Pod is restarted and re-enters the race.
+				os.Exit(1)
+			},
+			OnNewLeader: func(identity string) {
+				if identity == id {
+					return
+				}
+				c.log.V(1).Info("observed new leader", "identity", identity)
+			},
+		},
+	})
+}
+
+// lostLeadership reports whether the election loop stopped because leadership was actually
+// lost, as opposed to parentCtx being cancelled for an ordinary, intentional shutdown.
+func lostLeadership(parentCtx context.Context) bool {
+	return parentCtx.Err() == nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2019 Altinity Ltd and/or its affiliates. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chi
+
+import (
+	"context"
+	"testing"
+)
+
+// TestLostLeadershipDistinguishesShutdownFromLossOfLeadership guards OnStoppedLeading's
+// exit decision: os.Exit(1) must fire only when leadership was genuinely lost, never on an
+// ordinary, intentional shutdown of the parent ctx.
+func TestLostLeadershipDistinguishesShutdownFromLossOfLeadership(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if !lostLeadership(ctx) {
+		t.Fatalf("lostLeadership() = false while ctx is still live, want true")
+	}
+
+	cancel()
+
+	if lostLeadership(ctx) {
+		t.Fatalf("lostLeadership() = true after ctx was cancelled for shutdown, want false")
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2019 Altinity Ltd and/or its affiliates. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	chop "github.com/altinity/clickhouse-operator/pkg/apis/clickhouse.altinity.com/v1"
+	chopparser "github.com/altinity/clickhouse-operator/pkg/parser"
+
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/go-logr/logr"
+)
+
+// configHashAnnotation records a hash of the object's desired, reconciled-by-us fields.
+// reconcileControlledResources compares this annotation against the live object to skip
+// an Update() call when nothing actually changed.
+const configHashAnnotation = "clickhouse.altinity.com/config-hash"
+
+// reconcileControlledResources creates or updates the k8s resources generated from the
+// ClickHouseInstallation spec. Unlike the old create-once behavior, this always re-parses
+// the CHI and brings every ConfigMap, Service and StatefulSet in line with the current spec.
+func (c *Controller) reconcileControlledResources(log logr.Logger, chi *chop.ClickHouseInstallation) ([]string, error) {
+	chiCopy := chi.DeepCopy()
+	chiObjects, prefixes := chopparser.CreateObjects(chiCopy)
+
+	desiredConfigMaps := make(map[string]bool)
+	desiredServices := make(map[string]bool)
+	desiredStatefulSets := make(map[string]bool)
+
+	for _, objList := range chiObjects {
+		switch v := objList.(type) {
+		case chopparser.ConfigMapList:
+			for _, obj := range v {
+				desiredConfigMaps[obj.Name] = true
+				if err := c.reconcileConfigMap(log, chiCopy, obj); err != nil {
+					return nil, err
+				}
+			}
+		case chopparser.ServiceList:
+			for _, obj := range v {
+				desiredServices[obj.Name] = true
+				if err := c.reconcileService(log, chiCopy, obj); err != nil {
+					return nil, err
+				}
+			}
+		case chopparser.StatefulSetList:
+			for _, obj := range v {
+				desiredStatefulSets[obj.Name] = true
+				if err := c.reconcileStatefulSet(log, chiCopy, obj); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if err := c.pruneOrphanedResources(log, chiCopy, desiredConfigMaps, desiredServices, desiredStatefulSets); err != nil {
+		return nil, err
+	}
+
+	return prefixes, nil
+}
+
+// pruneOrphanedResources deletes every cluster-wide-labeled StatefulSet, ConfigMap and Service
+// that is no longer present in the freshly parsed object set - e.g. after a CHI spec shrinks
+// the number of shards/replicas.
+func (c *Controller) pruneOrphanedResources(log logr.Logger, chi *chop.ClickHouseInstallation, desiredConfigMaps, desiredServices, desiredStatefulSets map[string]bool) error {
+	selector := clusterWideSelector(chi.Name)
+
+	ssList, err := c.statefulSetLister.StatefulSets(chi.Namespace).List(selector)
+	if err != nil {
+		return err
+	}
+	for _, ss := range ssList {
+		if desiredStatefulSets[ss.Name] {
+			continue
+		}
+		if err := c.kubeClient.AppsV1().StatefulSets(chi.Namespace).Delete(ss.Name, nil); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.V(2).Info("deleted orphaned StatefulSet", "statefulSet", ss.Name)
+		c.recorder.Eventf(chi, core.EventTypeNormal, successSynced, "Deleted orphaned StatefulSet %q", ss.Name)
+	}
+
+	cmList, err := c.configMapLister.ConfigMaps(chi.Namespace).List(selector)
+	if err != nil {
+		return err
+	}
+	for _, cm := range cmList {
+		if desiredConfigMaps[cm.Name] {
+			continue
+		}
+		if err := c.kubeClient.CoreV1().ConfigMaps(chi.Namespace).Delete(cm.Name, nil); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.V(2).Info("deleted orphaned ConfigMap", "configMap", cm.Name)
+		c.recorder.Eventf(chi, core.EventTypeNormal, successSynced, "Deleted orphaned ConfigMap %q", cm.Name)
+	}
+
+	svcList, err := c.serviceLister.Services(chi.Namespace).List(selector)
+	if err != nil {
+		return err
+	}
+	for _, svc := range svcList {
+		if desiredServices[svc.Name] {
+			continue
+		}
+		if err := c.kubeClient.CoreV1().Services(chi.Namespace).Delete(svc.Name, nil); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.V(2).Info("deleted orphaned Service", "service", svc.Name)
+		c.recorder.Eventf(chi, core.EventTypeNormal, successSynced, "Deleted orphaned Service %q", svc.Name)
+	}
+
+	return nil
+}
+
+// reconcileConfigMap creates newConfigMap if it does not exist yet, otherwise updates the
+// live object when the hash of the desired data differs from its configHashAnnotation.
+// Edits made directly to the live object's data are not detected.
+func (c *Controller) reconcileConfigMap(log logr.Logger, chi *chop.ClickHouseInstallation, newConfigMap *core.ConfigMap) error {
+	setConfigHash(&newConfigMap.ObjectMeta, newConfigMap.Data)
+
+	existing, err := c.configMapLister.ConfigMaps(chi.Namespace).Get(newConfigMap.Name)
+	if apierrors.IsNotFound(err) {
+		if _, err := c.kubeClient.CoreV1().ConfigMaps(chi.Namespace).Create(newConfigMap); err != nil {
+			return err
+		}
+		log.V(2).Info("created ConfigMap", "configMap", newConfigMap.Name)
+		c.recorder.Eventf(chi, core.EventTypeNormal, successSynced, "Created ConfigMap %q", newConfigMap.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Annotations[configHashAnnotation] == newConfigMap.Annotations[configHashAnnotation] {
+		return nil
+	}
+
+	updated := existing.DeepCopy()
+	updated.Data = newConfigMap.Data
+	updated.Annotations = newConfigMap.Annotations
+	if _, err := c.kubeClient.CoreV1().ConfigMaps(chi.Namespace).Update(updated); err != nil {
+		c.recorder.Eventf(chi, core.EventTypeWarning, errResourceUpdateFailed, "Unable to update ConfigMap %q: %v", newConfigMap.Name, err)
+		return err
+	}
+	log.V(2).Info("updated ConfigMap", "configMap", newConfigMap.Name)
+	c.recorder.Eventf(chi, core.EventTypeNormal, successSynced, "Updated ConfigMap %q", newConfigMap.Name)
+	return nil
+}
+
+// reconcileService creates newService if it does not exist yet, otherwise updates the live
+// object when the hash of the desired spec differs from its configHashAnnotation, preserving
+// the immutable spec.clusterIP. Edits made directly to the live object are not detected.
+func (c *Controller) reconcileService(log logr.Logger, chi *chop.ClickHouseInstallation, newService *core.Service) error {
+	setConfigHash(&newService.ObjectMeta, newService.Spec)
+
+	existing, err := c.serviceLister.Services(chi.Namespace).Get(newService.Name)
+	if apierrors.IsNotFound(err) {
+		if _, err := c.kubeClient.CoreV1().Services(chi.Namespace).Create(newService); err != nil {
+			return err
+		}
+		log.V(2).Info("created Service", "service", newService.Name)
+		c.recorder.Eventf(chi, core.EventTypeNormal, successSynced, "Created Service %q", newService.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Annotations[configHashAnnotation] == newService.Annotations[configHashAnnotation] {
+		return nil
+	}
+
+	updated := existing.DeepCopy()
+	updated.Spec = newService.Spec
+	// clusterIP is immutable once assigned - keep whatever the live Service already has
+	updated.Spec.ClusterIP = existing.Spec.ClusterIP
+	updated.Annotations = newService.Annotations
+	if _, err := c.kubeClient.CoreV1().Services(chi.Namespace).Update(updated); err != nil {
+		c.recorder.Eventf(chi, core.EventTypeWarning, errResourceUpdateFailed, "Unable to update Service %q: %v", newService.Name, err)
+		return err
+	}
+	log.V(2).Info("updated Service", "service", newService.Name)
+	c.recorder.Eventf(chi, core.EventTypeNormal, successSynced, "Updated Service %q", newService.Name)
+	return nil
+}
+
+// reconcileStatefulSet creates newStatefulSet if it does not exist yet, otherwise updates the
+// live object when the hash of the desired spec differs from its configHashAnnotation,
+// preserving the immutable spec.volumeClaimTemplates. Edits made directly to the live object
+// are not detected.
+func (c *Controller) reconcileStatefulSet(log logr.Logger, chi *chop.ClickHouseInstallation, newStatefulSet *apps.StatefulSet) error {
+	setConfigHash(&newStatefulSet.ObjectMeta, newStatefulSet.Spec)
+
+	existing, err := c.statefulSetLister.StatefulSets(chi.Namespace).Get(newStatefulSet.Name)
+	if apierrors.IsNotFound(err) {
+		if _, err := c.kubeClient.AppsV1().StatefulSets(chi.Namespace).Create(newStatefulSet); err != nil {
+			return err
+		}
+		log.V(2).Info("created StatefulSet", "statefulSet", newStatefulSet.Name)
+		c.recorder.Eventf(chi, core.EventTypeNormal, successSynced, "Created StatefulSet %q", newStatefulSet.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Annotations[configHashAnnotation] == newStatefulSet.Annotations[configHashAnnotation] {
+		return nil
+	}
+
+	updated := existing.DeepCopy()
+	updated.Spec = newStatefulSet.Spec
+	updated.ResourceVersion = existing.ResourceVersion
+	// volumeClaimTemplates is immutable once the StatefulSet is created
+	updated.Spec.VolumeClaimTemplates = existing.Spec.VolumeClaimTemplates
+	updated.Annotations = newStatefulSet.Annotations
+	if _, err := c.kubeClient.AppsV1().StatefulSets(chi.Namespace).Update(updated); err != nil {
+		c.recorder.Eventf(chi, core.EventTypeWarning, errResourceUpdateFailed, "Unable to update StatefulSet %q: %v", newStatefulSet.Name, err)
+		return err
+	}
+	log.V(2).Info("updated StatefulSet", "statefulSet", newStatefulSet.Name)
+	c.recorder.Eventf(chi, core.EventTypeNormal, successSynced, "Updated StatefulSet %q", newStatefulSet.Name)
+	return nil
+}
+
+// setConfigHash stamps objMeta.Annotations[configHashAnnotation] with a hash of spec, so that
+// future reconciles can tell whether an Update() call is actually necessary.
+func setConfigHash(objMeta *meta.ObjectMeta, spec interface{}) {
+	if objMeta.Annotations == nil {
+		objMeta.Annotations = make(map[string]string)
+	}
+	objMeta.Annotations[configHashAnnotation] = hashOf(spec)
+}
+
+// hashOf returns a stable hex-encoded sha256 digest of spec's JSON representation
+func hashOf(spec interface{}) string {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		// Should not happen for the generated k8s API types we pass in here
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
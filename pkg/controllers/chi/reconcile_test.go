@@ -0,0 +1,117 @@
+// Copyright 2019 Altinity Ltd and/or its affiliates. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chi
+
+import (
+	"testing"
+
+	chop "github.com/altinity/clickhouse-operator/pkg/apis/clickhouse.altinity.com/v1"
+	chopparser "github.com/altinity/clickhouse-operator/pkg/parser"
+
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/go-logr/logr"
+)
+
+const testNamespace = "ns"
+const testChiName = "test-chi"
+
+// newReconcileTestController builds a Controller whose kubeClient and listers are backed by
+// objects, so reconcile.go/finalizer.go logic can be exercised without a real API server.
+func newReconcileTestController(t *testing.T, objects ...runtime.Object) (*Controller, *fake.Clientset) {
+	t.Helper()
+
+	kubeClient := fake.NewSimpleClientset(objects...)
+
+	cmIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	svcIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	ssIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+
+	for _, obj := range objects {
+		switch o := obj.(type) {
+		case *core.ConfigMap:
+			cmIndexer.Add(o)
+		case *core.Service:
+			svcIndexer.Add(o)
+		case *apps.StatefulSet:
+			ssIndexer.Add(o)
+		}
+	}
+
+	return &Controller{
+		kubeClient:        kubeClient,
+		configMapLister:   corelisters.NewConfigMapLister(cmIndexer),
+		serviceLister:     corelisters.NewServiceLister(svcIndexer),
+		statefulSetLister: appslisters.NewStatefulSetLister(ssIndexer),
+		recorder:          record.NewFakeRecorder(32),
+		log:               logr.Discard(),
+	}, kubeClient
+}
+
+func testChi() *chop.ClickHouseInstallation {
+	return &chop.ClickHouseInstallation{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      testChiName,
+			Namespace: testNamespace,
+		},
+	}
+}
+
+func labeledConfigMap(name string) *core.ConfigMap {
+	return &core.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    labels.Set{chopparser.ClusterwideLabel: testChiName},
+		},
+	}
+}
+
+// TestPruneOrphanedResourcesDeletesOnlyWhatIsNotDesired verifies that pruneOrphanedResources
+// deletes cluster-labeled ConfigMaps missing from the desired set, and leaves the rest alone -
+// this is the guard against an operator bug deleting resources a CHI still needs.
+func TestPruneOrphanedResourcesDeletesOnlyWhatIsNotDesired(t *testing.T) {
+	keep := labeledConfigMap("keep")
+	orphan := labeledConfigMap("orphan")
+
+	c, kubeClient := newReconcileTestController(t, keep, orphan)
+
+	err := c.pruneOrphanedResources(logr.Discard(), testChi(),
+		map[string]bool{"keep": true},
+		map[string]bool{},
+		map[string]bool{},
+	)
+	if err != nil {
+		t.Fatalf("pruneOrphanedResources() returned error: %v", err)
+	}
+
+	cms, err := kubeClient.CoreV1().ConfigMaps(testNamespace).List(meta.ListOptions{})
+	if err != nil {
+		t.Fatalf("listing ConfigMaps: %v", err)
+	}
+	if len(cms.Items) != 1 || cms.Items[0].Name != "keep" {
+		t.Fatalf("expected only %q to survive pruning, got %v", "keep", cms.Items)
+	}
+}
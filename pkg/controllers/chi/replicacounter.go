@@ -0,0 +1,262 @@
+// Copyright 2019 Altinity Ltd and/or its affiliates. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chi
+
+import (
+	"sync"
+	"time"
+
+	chop "github.com/altinity/clickhouse-operator/pkg/apis/clickhouse.altinity.com/v1"
+	choplisters "github.com/altinity/clickhouse-operator/pkg/client/listers/clickhouse.altinity.com/v1"
+	chopparser "github.com/altinity/clickhouse-operator/pkg/parser"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	labels "k8s.io/apimachinery/pkg/labels"
+	kube "k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+
+	"github.com/go-logr/logr"
+)
+
+// defaultReplicaCacheTTL is how long a CachedReplicaCounter trusts a previous answer before
+// it re-lists StatefulSets for a CHI.
+const defaultReplicaCacheTTL = 10 * time.Second
+
+// ReplicaCounter answers how many ClickHouse replicas a CHI currently has and which hostnames
+// they are reachable at. It backs chopmetrics.Exporter state instead of syncItem recomputing
+// it by hand (and assuming every replica in ObjectPrefixes is ready) on every reconcile. Both
+// methods take the CHI's namespace alongside its name: callers always have it to hand from the
+// CHI object already in scope, and a name lookup without it cannot disambiguate CHIs that share
+// a name across namespaces.
+type ReplicaCounter interface {
+	CountReplicas(namespace, chiName string) int
+	ListHostnames(namespace, chiName string) []string
+}
+
+// StatefulSetCounter reads status.readyReplicas straight from the StatefulSet lister, so it is
+// always live but pays a lister lookup per shard on every call.
+type StatefulSetCounter struct {
+	statefulSetLister appslisters.StatefulSetLister
+	chopLister        choplisters.ClickHouseInstallationLister
+}
+
+// NewStatefulSetCounter creates a StatefulSetCounter backed by the given listers.
+func NewStatefulSetCounter(statefulSetLister appslisters.StatefulSetLister, chopLister choplisters.ClickHouseInstallationLister) *StatefulSetCounter {
+	return &StatefulSetCounter{statefulSetLister: statefulSetLister, chopLister: chopLister}
+}
+
+func (s *StatefulSetCounter) CountReplicas(namespace, chiName string) int {
+	chi, err := s.chopLister.ClickHouseInstallations(namespace).Get(chiName)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, prefix := range chi.Status.ObjectPrefixes {
+		ss, err := s.statefulSetLister.StatefulSets(namespace).Get(chopparser.CreateStatefulSetName(prefix))
+		if err != nil {
+			continue
+		}
+		count += int(ss.Status.ReadyReplicas)
+	}
+	return count
+}
+
+func (s *StatefulSetCounter) ListHostnames(namespace, chiName string) []string {
+	chi, err := s.chopLister.ClickHouseInstallations(namespace).Get(chiName)
+	if err != nil {
+		return nil
+	}
+	hostnames := make([]string, 0, len(chi.Status.ObjectPrefixes))
+	for _, prefix := range chi.Status.ObjectPrefixes {
+		ss, err := s.statefulSetLister.StatefulSets(namespace).Get(chopparser.CreateStatefulSetName(prefix))
+		if err != nil || ss.Status.ReadyReplicas == 0 {
+			continue
+		}
+		hostnames = append(hostnames, chopparser.CreatePodHostname(namespace, prefix))
+	}
+	return hostnames
+}
+
+type replicaCacheEntry struct {
+	count     int
+	hostnames []string
+	expiresAt time.Time
+}
+
+// CachedReplicaCounter wraps another ReplicaCounter with a per-CHI TTL, refreshing only when
+// the cached value has expired. This is what hot reconcile loops should consume, since
+// StatefulSetCounter pays a lister lookup per shard and LeaseBackedCounter an API List per call.
+type CachedReplicaCounter struct {
+	inner ReplicaCounter
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]replicaCacheEntry
+}
+
+// NewCachedReplicaCounter wraps inner with a ttl-bounded cache. A ttl <= 0 falls back to
+// defaultReplicaCacheTTL.
+func NewCachedReplicaCounter(inner ReplicaCounter, ttl time.Duration) *CachedReplicaCounter {
+	if ttl <= 0 {
+		ttl = defaultReplicaCacheTTL
+	}
+	return &CachedReplicaCounter{
+		inner: inner,
+		ttl:   ttl,
+		cache: make(map[string]replicaCacheEntry),
+	}
+}
+
+func (c *CachedReplicaCounter) entry(namespace, chiName string) replicaCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := namespace + "/" + chiName
+	if e, ok := c.cache[key]; ok && time.Now().Before(e.expiresAt) {
+		return e
+	}
+
+	e := replicaCacheEntry{
+		count:     c.inner.CountReplicas(namespace, chiName),
+		hostnames: c.inner.ListHostnames(namespace, chiName),
+		expiresAt: time.Now().Add(c.ttl),
+	}
+	c.cache[key] = e
+	return e
+}
+
+func (c *CachedReplicaCounter) CountReplicas(namespace, chiName string) int {
+	return c.entry(namespace, chiName).count
+}
+
+func (c *CachedReplicaCounter) ListHostnames(namespace, chiName string) []string {
+	return c.entry(namespace, chiName).hostnames
+}
+
+// LeaseBackedCounter publishes a coordination.k8s.io/v1 Lease per pod prefix, renewed by the
+// operator while the backing pod is Ready, so external tooling can observe live replica
+// membership without polling the API server or going through the cache TTL above. The chi
+// controller drives it from publishReplicaLeases below, once per reconcile.
+type LeaseBackedCounter struct {
+	kubeClient    kube.Interface
+	leaseDuration time.Duration
+	log           logr.Logger
+}
+
+// NewLeaseBackedCounter creates a LeaseBackedCounter whose Leases carry leaseDuration as
+// their LeaseDurationSeconds. A Lease is renewed only when Heartbeat is called for its prefix.
+func NewLeaseBackedCounter(kubeClient kube.Interface, leaseDuration time.Duration, log logr.Logger) *LeaseBackedCounter {
+	return &LeaseBackedCounter{kubeClient: kubeClient, leaseDuration: leaseDuration, log: log}
+}
+
+// Heartbeat creates or renews the Lease for chiName/prefix, recording hostname as its holder.
+// Callers typically invoke this once per reconcile, after observing the backing pod is Ready.
+func (l *LeaseBackedCounter) Heartbeat(namespace, chiName, prefix, hostname string) error {
+	name := leaseName(prefix)
+	now := meta.NewMicroTime(time.Now())
+	renewSeconds := int32(l.leaseDuration.Seconds())
+
+	lease, err := l.kubeClient.CoordinationV1().Leases(namespace).Get(name, meta.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    labels.Set{chopparser.ClusterwideLabel: chiName},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &hostname,
+				LeaseDurationSeconds: &renewSeconds,
+				RenewTime:            &now,
+			},
+		}
+		_, err = l.kubeClient.CoordinationV1().Leases(namespace).Create(lease)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	lease = lease.DeepCopy()
+	lease.Spec.HolderIdentity = &hostname
+	lease.Spec.LeaseDurationSeconds = &renewSeconds
+	lease.Spec.RenewTime = &now
+	_, err = l.kubeClient.CoordinationV1().Leases(namespace).Update(lease)
+	return err
+}
+
+// Release deletes the Lease for prefix, e.g. once its pod stops being Ready.
+func (l *LeaseBackedCounter) Release(namespace, prefix string) error {
+	err := l.kubeClient.CoordinationV1().Leases(namespace).Delete(leaseName(prefix), nil)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// CountReplicas counts the Leases currently held in namespace for chiName.
+func (l *LeaseBackedCounter) CountReplicas(namespace, chiName string) int {
+	return len(l.ListHostnames(namespace, chiName))
+}
+
+// ListHostnames lists the pod hostnames recorded by a live Lease for chiName in namespace.
+func (l *LeaseBackedCounter) ListHostnames(namespace, chiName string) []string {
+	leases, err := l.kubeClient.CoordinationV1().Leases(namespace).List(meta.ListOptions{
+		LabelSelector: clusterWideSelector(chiName).String(),
+	})
+	if err != nil {
+		l.log.V(2).Info("unable to list leases", "chi", chiName, "error", err)
+		return nil
+	}
+
+	hostnames := make([]string, 0, len(leases.Items))
+	for _, lease := range leases.Items {
+		if lease.Spec.HolderIdentity == nil {
+			continue
+		}
+		hostnames = append(hostnames, *lease.Spec.HolderIdentity)
+	}
+	return hostnames
+}
+
+// leaseName derives the per-shard Lease name from its object prefix
+func leaseName(prefix string) string {
+	return "chi-" + prefix
+}
+
+// publishReplicaLeases heartbeats a Lease for every prefix whose StatefulSet currently has at
+// least one ready replica, and releases the Lease for every prefix that does not. Only the
+// given prefixes are touched: a Lease of a prefix that is no longer among them is not released.
+func (c *Controller) publishReplicaLeases(log logr.Logger, chi *chop.ClickHouseInstallation, prefixes []string) {
+	if c.leaseCounter == nil {
+		return
+	}
+	for _, prefix := range prefixes {
+		ss, err := c.statefulSetLister.StatefulSets(chi.Namespace).Get(chopparser.CreateStatefulSetName(prefix))
+		if err != nil || ss.Status.ReadyReplicas == 0 {
+			if err := c.leaseCounter.Release(chi.Namespace, prefix); err != nil {
+				log.V(2).Info("unable to release replica lease", "prefix", prefix, "error", err)
+			}
+			continue
+		}
+		hostname := chopparser.CreatePodHostname(chi.Namespace, prefix)
+		if err := c.leaseCounter.Heartbeat(chi.Namespace, chi.Name, prefix, hostname); err != nil {
+			log.V(2).Info("unable to heartbeat replica lease", "prefix", prefix, "error", err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 Altinity Ltd and/or its affiliates. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chi
+
+import (
+	"testing"
+	"time"
+
+	chopparser "github.com/altinity/clickhouse-operator/pkg/parser"
+
+	apps "k8s.io/api/apps/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/go-logr/logr"
+)
+
+// readyStatefulSet builds a minimal StatefulSet reporting readyReplicas, for exercising
+// readiness-driven logic (publishReplicaLeases, StatefulSetCounter) without a real cluster.
+func readyStatefulSet(name string, readyReplicas int32) *apps.StatefulSet {
+	return &apps.StatefulSet{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+		},
+		Status: apps.StatefulSetStatus{
+			ReadyReplicas: readyReplicas,
+		},
+	}
+}
+
+// countingReplicaCounter wraps a fixed answer and counts how many times it was asked, so
+// CachedReplicaCounter's TTL behavior can be observed without a real lister.
+type countingReplicaCounter struct {
+	count     int
+	hostnames []string
+	refreshes int
+}
+
+func (c *countingReplicaCounter) CountReplicas(namespace, chiName string) int {
+	c.refreshes++
+	return c.count
+}
+
+func (c *countingReplicaCounter) ListHostnames(namespace, chiName string) []string {
+	return c.hostnames
+}
+
+// TestCachedReplicaCounterReusesEntryUntilTTLExpires verifies that repeated calls within the
+// TTL window are served from cache, and that a call after expiry refreshes from inner.
+func TestCachedReplicaCounterReusesEntryUntilTTLExpires(t *testing.T) {
+	inner := &countingReplicaCounter{count: 3, hostnames: []string{"a", "b", "c"}}
+	cached := NewCachedReplicaCounter(inner, 30*time.Millisecond)
+
+	if got := cached.CountReplicas(testNamespace, testChiName); got != 3 {
+		t.Fatalf("CountReplicas() = %d, want 3", got)
+	}
+	if got := cached.CountReplicas(testNamespace, testChiName); got != 3 {
+		t.Fatalf("CountReplicas() = %d, want 3", got)
+	}
+	if inner.refreshes != 1 {
+		t.Fatalf("inner was refreshed %d times within the TTL window, want 1 (cached)", inner.refreshes)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+
+	if got := cached.CountReplicas(testNamespace, testChiName); got != 3 {
+		t.Fatalf("CountReplicas() after TTL expiry = %d, want 3", got)
+	}
+	if inner.refreshes != 2 {
+		t.Fatalf("inner was refreshed %d times after TTL expiry, want 2 (one refresh)", inner.refreshes)
+	}
+}
+
+// TestCachedReplicaCounterKeysByNamespace verifies that two CHIs sharing a name in different
+// namespaces get independent cache entries instead of colliding on name alone.
+func TestCachedReplicaCounterKeysByNamespace(t *testing.T) {
+	inner := &countingReplicaCounter{count: 1}
+	cached := NewCachedReplicaCounter(inner, time.Minute)
+
+	cached.CountReplicas("ns-a", testChiName)
+	cached.CountReplicas("ns-b", testChiName)
+
+	if inner.refreshes != 2 {
+		t.Fatalf("inner was refreshed %d times for two distinct namespaces, want 2", inner.refreshes)
+	}
+}
+
+func newLeaseBackedCounter(t *testing.T) (*LeaseBackedCounter, *fake.Clientset) {
+	t.Helper()
+	kubeClient := fake.NewSimpleClientset()
+	return NewLeaseBackedCounter(kubeClient, time.Minute, logr.Discard()), kubeClient
+}
+
+// TestLeaseBackedCounterHeartbeatCreatesThenRenews verifies Heartbeat creates the Lease on
+// first call and updates its holder identity on a later call for the same prefix.
+func TestLeaseBackedCounterHeartbeatCreatesThenRenews(t *testing.T) {
+	l, kubeClient := newLeaseBackedCounter(t)
+
+	if err := l.Heartbeat(testNamespace, testChiName, "0-0", "host-a"); err != nil {
+		t.Fatalf("Heartbeat() returned error: %v", err)
+	}
+
+	lease, err := kubeClient.CoordinationV1().Leases(testNamespace).Get(leaseName("0-0"), meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting created Lease: %v", err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != "host-a" {
+		t.Fatalf("Lease holder = %v, want host-a", lease.Spec.HolderIdentity)
+	}
+
+	if err := l.Heartbeat(testNamespace, testChiName, "0-0", "host-b"); err != nil {
+		t.Fatalf("Heartbeat() renewal returned error: %v", err)
+	}
+
+	lease, err = kubeClient.CoordinationV1().Leases(testNamespace).Get(leaseName("0-0"), meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting renewed Lease: %v", err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != "host-b" {
+		t.Fatalf("Lease holder after renewal = %v, want host-b", lease.Spec.HolderIdentity)
+	}
+}
+
+// TestLeaseBackedCounterListHostnamesReflectsHeartbeats verifies ListHostnames/CountReplicas
+// surface every Lease currently held for chiName, scoped to namespace.
+func TestLeaseBackedCounterListHostnamesReflectsHeartbeats(t *testing.T) {
+	l, _ := newLeaseBackedCounter(t)
+
+	if err := l.Heartbeat(testNamespace, testChiName, "0-0", "host-a"); err != nil {
+		t.Fatalf("Heartbeat() returned error: %v", err)
+	}
+	if err := l.Heartbeat(testNamespace, testChiName, "0-1", "host-b"); err != nil {
+		t.Fatalf("Heartbeat() returned error: %v", err)
+	}
+
+	hostnames := l.ListHostnames(testNamespace, testChiName)
+	if len(hostnames) != 2 {
+		t.Fatalf("ListHostnames() = %v, want 2 entries", hostnames)
+	}
+	if count := l.CountReplicas(testNamespace, testChiName); count != 2 {
+		t.Fatalf("CountReplicas() = %d, want 2", count)
+	}
+}
+
+// TestLeaseBackedCounterReleaseRemovesLease verifies Release deletes the Lease for a prefix,
+// and is a no-op (not an error) when the Lease is already gone.
+func TestLeaseBackedCounterReleaseRemovesLease(t *testing.T) {
+	l, _ := newLeaseBackedCounter(t)
+
+	if err := l.Heartbeat(testNamespace, testChiName, "0-0", "host-a"); err != nil {
+		t.Fatalf("Heartbeat() returned error: %v", err)
+	}
+	if err := l.Release(testNamespace, "0-0"); err != nil {
+		t.Fatalf("Release() returned error: %v", err)
+	}
+
+	if hostnames := l.ListHostnames(testNamespace, testChiName); len(hostnames) != 0 {
+		t.Fatalf("ListHostnames() after Release() = %v, want none", hostnames)
+	}
+
+	if err := l.Release(testNamespace, "0-0"); err != nil {
+		t.Fatalf("Release() of an already-released prefix returned error: %v", err)
+	}
+}
+
+// TestPublishReplicaLeasesHeartbeatsReadyAndReleasesNotReady verifies the reconcile-path
+// helper that drives the Lease wiring above: a ready StatefulSet gets a heartbeat, a
+// not-ready (or missing) one gets released.
+func TestPublishReplicaLeasesHeartbeatsReadyAndReleasesNotReady(t *testing.T) {
+	ready := readyStatefulSet(chopparser.CreateStatefulSetName("ready"), 1)
+	notReady := readyStatefulSet(chopparser.CreateStatefulSetName("not-ready"), 0)
+
+	c, kubeClient := newReconcileTestController(t, ready, notReady)
+	c.leaseCounter = NewLeaseBackedCounter(kubeClient, time.Minute, logr.Discard())
+
+	if err := c.leaseCounter.Heartbeat(testNamespace, testChiName, "not-ready", "stale-host"); err != nil {
+		t.Fatalf("seeding a stale Lease: %v", err)
+	}
+
+	c.publishReplicaLeases(logr.Discard(), testChi(), []string{"ready", "not-ready"})
+
+	hostnames := c.leaseCounter.ListHostnames(testNamespace, testChiName)
+	if len(hostnames) != 1 || hostnames[0] != chopparser.CreatePodHostname(testNamespace, "ready") {
+		t.Fatalf("ListHostnames() after publishReplicaLeases() = %v, want only the ready prefix's hostname", hostnames)
+	}
+}